@@ -0,0 +1,278 @@
+// +build (linux,!android) || freebsd
+
+package systemd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	sdActivation "github.com/coreos/go-systemd/v22/activation"
+	sdDaemon "github.com/coreos/go-systemd/v22/daemon"
+	sdDbus "github.com/coreos/go-systemd/v22/dbus"
+	sdUtil "github.com/coreos/go-systemd/v22/util"
+)
+
+// dbusConnectTimeout bounds how long we'll wait to connect to the user D-Bus
+// before falling back to isUserSystemdRunningViaSystemctl, and is also used
+// as WaitForNotifyDelivery's default timeout when the caller's context has
+// no deadline of its own.
+const dbusConnectTimeout = 5 * time.Second
+
+// IsUserSystemdRunning checks that systemd is running at the user- (as opposed
+// to system-) level. IsRunningSystemd below checks the system level, but there
+// are cases where the system level is working while the user level is not.
+// Sudo env weirdness can cause it, and it also happens on older distros. In
+// those cases, we'll also fall back to non-systemd startup.
+//
+// This function prints loud warnings because we only ever run it when
+// IsRunningSystemd is true, in which case all of these errors are unexpected.
+//
+// NOTE: This logic is duplicated in run_keybase. If you make changes here,
+// keep them in sync.
+func IsUserSystemdRunning() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), dbusConnectTimeout)
+	defer cancel()
+
+	conn, err := sdDbus.NewUserConnectionContext(ctx)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Failed to connect to user D-Bus, falling back to systemctl: %s\n", err))
+		return isUserSystemdRunningViaSystemctl()
+	}
+	defer conn.Close()
+
+	state, err := getDbusManagerProperty(conn, "SystemState")
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Failed to query SystemState over D-Bus, falling back to systemctl: %s\n", err))
+		return isUserSystemdRunningViaSystemctl()
+	}
+
+	if state == "running" {
+		return true
+	} else if state == "degraded" {
+		// "degraded" just means that some service has failed to start. That could
+		// be a totally unrelated application on the user's machine, so we treat it
+		// the same as "running", but enforce that dbus is running as well.
+		activeState, err := getDbusUnitProperty(conn, "dbus.service", "ActiveState")
+		if err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("Failed to query dbus.service ActiveState over D-Bus: %s\n", err))
+			return false
+		}
+		return activeState == "active"
+	} else if state == "" {
+		os.Stderr.WriteString(fmt.Sprintf("Failed to reach user-level systemd daemon.\n"))
+		return false
+	} else {
+		os.Stderr.WriteString(fmt.Sprintf("Systemd reported an unexpected status: %s\n", state))
+		return false
+	}
+}
+
+// getDbusManagerProperty fetches a property off systemd's Manager object
+// (e.g. "SystemState") and unwraps it from its dbus string representation.
+func getDbusManagerProperty(conn *sdDbus.Conn, name string) (string, error) {
+	raw, err := conn.GetManagerProperty(name)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Unquote(raw)
+}
+
+// getDbusUnitProperty fetches a single property (e.g. "ActiveState") off a
+// named unit and unwraps it from its dbus variant representation.
+func getDbusUnitProperty(conn *sdDbus.Conn, unit, name string) (string, error) {
+	prop, err := conn.GetUnitProperty(unit, name)
+	if err != nil {
+		return "", err
+	}
+	value, ok := prop.Value.Value().(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected dbus type for %s.%s: %T", unit, name, prop.Value.Value())
+	}
+	return value, nil
+}
+
+func IsRunningSystemd() bool {
+	return sdUtil.IsRunningSystemd() && IsUserSystemdRunning()
+}
+
+// NOTE: We no longer configure our keybse.service and kbfs.service units to be
+// socket-activated by default. It was causing too much trouble when
+// non-systemd instances deleted the socket files. It's possible this issue
+// will get fixed in future versions of systemd; see
+// https://github.com/systemd/systemd/issues/7274.
+//
+// The generated units in systemd/units follow the same rule: the .socket
+// units they emit carry no WantedBy=, and the .service units carry no
+// Requires=<name>.socket, so socket activation stays opt-in rather than
+// coming back by default.
+func IsSocketActivated() bool {
+	return (os.Getenv("LISTEN_FDS") != "")
+}
+
+// GetListenersByName returns the sockets passed down from systemd via
+// socket activation, keyed by their FileDescriptorName= (LISTEN_FDNAMES).
+// This lets a single .service unit be handed several distinct sockets (e.g.
+// the service API, KBFS, and a debug/metrics endpoint) via matching
+// ListenStream= entries in a .socket unit, each with its own
+// FileDescriptorName=. Sockets with no name end up under the empty string
+// key.
+func GetListenersByName() (map[string]net.Listener, error) {
+	// NOTE: If we ever set unsetEnv=true, we need to change IsSocketActivated above.
+	listenersByName, err := sdActivation.ListenersWithNames(false /* unsetEnv */)
+	if err != nil {
+		// Errors here (e.g. out of file descriptors, maybe?) aren't even
+		// returned by go-systemd right now, but they could be in the future.
+		return nil, err
+	}
+	return collapseListenersByName(listenersByName)
+}
+
+func collapseListenersByName(listenersByName map[string][]net.Listener) (map[string]net.Listener, error) {
+	result := make(map[string]net.Listener, len(listenersByName))
+	for name, listeners := range listenersByName {
+		if len(listeners) > 1 {
+			// More than one socket under the same name probably means a
+			// messed up .service/.socket file.
+			return nil, fmt.Errorf("too many listeners passed from systemd for socket name %q", name)
+		}
+		if len(listeners) == 1 {
+			result[name] = listeners[0]
+		}
+	}
+	return result, nil
+}
+
+// GetPacketConnsByName is the GetListenersByName equivalent for
+// connectionless sockets (UDP or Unixgram), keyed by FileDescriptorName=.
+// go-systemd's activation package only exposes a names-agnostic
+// PacketConns, with no *WithNames variant, so we group by name ourselves
+// off of the same activation.Files that ListenersWithNames uses internally.
+func GetPacketConnsByName() (map[string]net.PacketConn, error) {
+	files := sdActivation.Files(false /* unsetEnv */)
+	connsByName := make(map[string][]net.PacketConn, len(files))
+	for _, f := range files {
+		// net.FilePacketConn dups f's underlying fd into conn (or fails
+		// without touching it), so we must close our copy either way or it
+		// leaks for the life of the process. Mirrors what ListenersWithNames
+		// does internally for net.FileListener.
+		conn, err := net.FilePacketConn(f)
+		f.Close()
+		if err == nil {
+			connsByName[f.Name()] = append(connsByName[f.Name()], conn)
+		}
+	}
+	return collapsePacketConnsByName(connsByName)
+}
+
+func collapsePacketConnsByName(connsByName map[string][]net.PacketConn) (map[string]net.PacketConn, error) {
+	result := make(map[string]net.PacketConn, len(connsByName))
+	for name, conns := range connsByName {
+		if len(conns) > 1 {
+			return nil, fmt.Errorf("too many packet conns passed from systemd for socket name %q", name)
+		}
+		if len(conns) == 1 {
+			result[name] = conns[0]
+		}
+	}
+	return result, nil
+}
+
+// GetListenerFromEnvironment is a thin wrapper around GetListenersByName for
+// callers that only expect a single, unnamed socket from systemd. If the
+// service has been started via socket activation, with a socket already
+// open in the environment, return that socket. Otherwise return (nil, nil).
+func GetListenerFromEnvironment() (net.Listener, error) {
+	listeners, err := GetListenersByName()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) > 1 {
+		// More than one socket here probably means a messed up .service file.
+		// Callers that expect several named sockets should use
+		// GetListenersByName instead.
+		return nil, errors.New("Too many listeners passed from systemd.")
+	}
+	for _, listener := range listeners {
+		// Found a socket in the environment. Return it.
+		return listener, nil
+	}
+	// No socket found. Either we're not running under systemd at all, or the
+	// socket isn't configured. The caller will create its own socket.
+	return nil, nil
+}
+
+func NotifyStartupFinished() {
+	sdDaemon.SdNotify(false /* unsetEnv */, "READY=1")
+}
+
+// WaitForNotifyDelivery blocks until the READY=1 (or any other pending)
+// sd_notify message has actually been received and processed by systemd,
+// using the SdNotifyBarrier round-trip. Callers that need to be sure
+// NotifyStartupFinished was observed before proceeding (e.g. before telling
+// a supervisor it's safe to depend on us) should call this right after.
+func WaitForNotifyDelivery(ctx context.Context) error {
+	timeout := dbusConnectTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	return sdDaemon.SdNotifyBarrier(timeout)
+}
+
+// NotifyReloading tells systemd that we're reloading our configuration, so
+// it knows to wait for a follow-up NotifyStartupFinished (READY=1) rather
+// than assuming we're already up.
+func NotifyReloading() {
+	sdDaemon.SdNotify(false /* unsetEnv */, "RELOADING=1")
+}
+
+// NotifyStopping tells systemd that we're beginning a clean shutdown. This
+// is purely informational (systemd already knows we're stopping once our
+// process exits), but it lets `systemctl status` and the journal show
+// accurate state while the shutdown is in progress.
+func NotifyStopping() {
+	sdDaemon.SdNotify(false /* unsetEnv */, "STOPPING=1")
+}
+
+// NotifyStatus sets a free-form single-line status string that shows up in
+// `systemctl status` for our unit, e.g. "Indexing 4/10 conversations".
+func NotifyStatus(status string) {
+	sdDaemon.SdNotify(false /* unsetEnv */, "STATUS="+status)
+}
+
+// StartWatchdog starts a goroutine that pings systemd's watchdog, if the
+// unit has WatchdogSec= configured (and thus Type=notify). Per the
+// sd_notify(3) contract, systemd expects a WATCHDOG=1 message at least once
+// every WATCHDOG_USEC microseconds, or it considers the service hung and
+// restarts it; we ping at twice that rate to leave margin for scheduling
+// jitter. If WATCHDOG_USEC isn't set in the environment, this is a no-op.
+// The goroutine exits when ctx is canceled.
+func StartWatchdog(ctx context.Context) {
+	usecStr := os.Getenv("WATCHDOG_USEC")
+	if usecStr == "" {
+		return
+	}
+	usec, err := strconv.ParseInt(usecStr, 10, 64)
+	if err != nil || usec <= 0 {
+		os.Stderr.WriteString(fmt.Sprintf("Failed to parse WATCHDOG_USEC %q: %s\n", usecStr, err))
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sdDaemon.SdNotify(false /* unsetEnv */, "WATCHDOG=1")
+			}
+		}
+	}()
+}
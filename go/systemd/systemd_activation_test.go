@@ -0,0 +1,169 @@
+// +build (linux,!android) || freebsd
+
+package systemd
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNotifySocket spins up a throwaway AF_UNIX datagram socket and points
+// NOTIFY_SOCKET at it, standing in for systemd's real notification socket.
+func fakeNotifySocket(t *testing.T) (conn *net.UnixConn, cleanup func()) {
+	dir := t.TempDir()
+	addr := &net.UnixAddr{Name: dir + "/notify.sock", Net: "unixgram"}
+	conn, err := net.ListenUnixgram("unixgram", addr)
+	require.NoError(t, err)
+
+	restoreSocket := setEnvForTest(t, "NOTIFY_SOCKET", addr.Name)
+	return conn, func() {
+		conn.Close()
+		restoreSocket()
+	}
+}
+
+// setEnvForTest sets an environment variable and returns a func that puts
+// the previous value back.
+func setEnvForTest(t *testing.T, key, value string) (restore func()) {
+	old, had := os.LookupEnv(key)
+	require.NoError(t, os.Setenv(key, value))
+	return func() {
+		if had {
+			require.NoError(t, os.Setenv(key, old))
+		} else {
+			require.NoError(t, os.Unsetenv(key))
+		}
+	}
+}
+
+func readDatagram(t *testing.T, conn *net.UnixConn) string {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestNotifyLifecycle(t *testing.T) {
+	conn, cleanup := fakeNotifySocket(t)
+	defer cleanup()
+
+	NotifyReloading()
+	require.Equal(t, "RELOADING=1", readDatagram(t, conn))
+
+	NotifyStatus("working")
+	require.Equal(t, "STATUS=working", readDatagram(t, conn))
+
+	NotifyStopping()
+	require.Equal(t, "STOPPING=1", readDatagram(t, conn))
+}
+
+func TestNotifyWithoutSocket(t *testing.T) {
+	restore := setEnvForTest(t, "NOTIFY_SOCKET", "")
+	defer restore()
+
+	// None of these should panic or block when NOTIFY_SOCKET is unset.
+	NotifyReloading()
+	NotifyStopping()
+	NotifyStatus("unused")
+}
+
+func TestStartWatchdog(t *testing.T) {
+	conn, cleanup := fakeNotifySocket(t)
+	defer cleanup()
+
+	restoreUsec := setEnvForTest(t, "WATCHDOG_USEC", strconv.Itoa(20*1000)) // 20ms -> pings every 10ms
+	defer restoreUsec()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	StartWatchdog(ctx)
+
+	require.Equal(t, "WATCHDOG=1", readDatagram(t, conn))
+	require.Equal(t, "WATCHDOG=1", readDatagram(t, conn))
+	cancel()
+}
+
+func TestStartWatchdogNoUsec(t *testing.T) {
+	restore := setEnvForTest(t, "WATCHDOG_USEC", "")
+	defer restore()
+
+	// With no WATCHDOG_USEC, StartWatchdog should simply return without
+	// spawning a goroutine.
+	StartWatchdog(context.Background())
+}
+
+// These exercise the map-collapsing logic that GetListenersByName and
+// GetPacketConnsByName build on, without going through systemd's actual
+// LISTEN_FDS/LISTEN_FDNAMES file-descriptor-passing protocol (which would
+// require re-execing this binary as a child with pre-opened fds to
+// simulate faithfully).
+
+func TestCollapseListenersByName(t *testing.T) {
+	keybase, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer keybase.Close()
+	kbfs, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer kbfs.Close()
+
+	result, err := collapseListenersByName(map[string][]net.Listener{
+		"keybase": {keybase},
+		"kbfs":    {kbfs},
+		"":        {},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]net.Listener{"keybase": keybase, "kbfs": kbfs}, result)
+}
+
+func TestCollapseListenersByNameTooMany(t *testing.T) {
+	a, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer b.Close()
+
+	_, err = collapseListenersByName(map[string][]net.Listener{"keybase": {a, b}})
+	require.Error(t, err)
+}
+
+func TestCollapsePacketConnsByName(t *testing.T) {
+	debug, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer debug.Close()
+
+	result, err := collapsePacketConnsByName(map[string][]net.PacketConn{
+		"debug": {debug},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]net.PacketConn{"debug": debug}, result)
+}
+
+func TestCollapsePacketConnsByNameTooMany(t *testing.T) {
+	a, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer b.Close()
+
+	_, err = collapsePacketConnsByName(map[string][]net.PacketConn{"debug": {a, b}})
+	require.Error(t, err)
+}
+
+func TestGetListenerFromEnvironmentNoSockets(t *testing.T) {
+	// With LISTEN_FDS unset, GetListenerFromEnvironment should report no
+	// socket found rather than erroring.
+	restore := setEnvForTest(t, "LISTEN_FDS", "")
+	defer restore()
+
+	listener, err := GetListenerFromEnvironment()
+	require.NoError(t, err)
+	require.Nil(t, listener)
+}
@@ -0,0 +1,18 @@
+// +build freebsd
+
+package systemd
+
+import (
+	"fmt"
+	"os"
+)
+
+// isUserSystemdRunningViaSystemctl is the fallback used when we can't reach
+// the user D-Bus directly. FreeBSD's systemd-compatible supervisors don't
+// ship a `systemctl` binary, so there's no subprocess fallback to shell out
+// to here; if the D-Bus probe fails, we just report systemd as unavailable
+// and let the caller fall back to non-systemd startup.
+func isUserSystemdRunningViaSystemctl() bool {
+	os.Stderr.WriteString(fmt.Sprintf("No systemctl fallback available on this platform.\n"))
+	return false
+}
@@ -0,0 +1,159 @@
+// Package units generates the systemd user units that run the Keybase
+// service and KBFS, along with .socket units that are only used if socket
+// activation is enabled by hand (see serviceUnit). They used to live as static
+// templates inside run_keybase and would quietly drift out of sync with the
+// Go code that actually consumes the sockets and sd_notify messages those
+// units describe (see e.g. the stale comment there about disabling socket
+// activation). Generating them from the same place that defines the
+// FileDescriptorName= values and watchdog behavior keeps the two in sync.
+//
+// This package only provides the generator (Generate/WriteAll); it does not
+// wire up a `keybase ctl install-units` subcommand. That belongs in the
+// libcmdline/client command tree, which isn't part of this checkout, so
+// hooking it up is left to whoever lands this alongside the rest of `keybase
+// ctl`. A command there should call WriteAll(cfg, destDir) with destDir from
+// DefaultDestDir().
+package units
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/go-systemd/v22/unit"
+)
+
+// Config describes the machine-specific values that get baked into the
+// generated unit files.
+type Config struct {
+	// KeybaseBinaryPath is the absolute path to the installed `keybase`
+	// binary, used as ExecStart= for keybase.service.
+	KeybaseBinaryPath string
+	// KBFSBinaryPath is the absolute path to the installed `kbfsfuse`
+	// binary, used as ExecStart= for kbfs.service.
+	KBFSBinaryPath string
+	// RuntimeDir is $XDG_RUNTIME_DIR, where the keybase/kbfs sockets live.
+	RuntimeDir string
+	// WatchdogSec, if non-empty, is written as WatchdogSec= on
+	// keybase.service and kbfs.service, matching the interval StartWatchdog
+	// expects via WATCHDOG_USEC.
+	WatchdogSec string
+}
+
+// socketPath returns the path to the named domain socket under RuntimeDir.
+func (c Config) socketPath(name string) string {
+	return filepath.Join(c.RuntimeDir, name)
+}
+
+// namedUnits returns every generated unit, keyed by filename (e.g.
+// "keybase.service").
+func (c Config) namedUnits() map[string][]*unit.UnitOption {
+	return map[string][]*unit.UnitOption{
+		"keybase.service": c.serviceUnit("keybase", "Keybase service", c.KeybaseBinaryPath+" service"),
+		"kbfs.service":    c.serviceUnit("kbfs", "KBFS", c.KBFSBinaryPath),
+		"keybase.socket":  c.socketUnit("keybase", "keybased.sock"),
+		"kbfs.socket":     c.socketUnit("kbfs", "kbfsd.sock"),
+	}
+}
+
+// serviceUnit builds the .service unit for the given component. name is
+// also used as the FileDescriptorName= that the matching .socket unit
+// advertises, if the user chooses to enable it, for systemd.GetListenersByName
+// to look up. We deliberately don't wire Requires=<name>.socket here: as
+// noted in systemd.IsSocketActivated, socket activation isn't on by default
+// because systemd has historically deleted the socket file out from under
+// non-systemd instances (systemd/systemd#7274). The service instead opens
+// its own socket at RuntimeDir/<socketFile>, the same path the generated
+// .socket unit below uses, so the two agree if socket activation is ever
+// enabled by hand. execStart is the full command line to run, e.g.
+// "/usr/bin/keybase service".
+func (c Config) serviceUnit(name, description, execStart string) []*unit.UnitOption {
+	opts := []*unit.UnitOption{
+		{Section: "Unit", Name: "Description", Value: description},
+		{Section: "Service", Name: "Type", Value: "notify"},
+		{Section: "Service", Name: "ExecStart", Value: execStart},
+		{Section: "Service", Name: "Restart", Value: "on-failure"},
+		{Section: "Install", Name: "WantedBy", Value: "default.target"},
+	}
+	if c.WatchdogSec != "" {
+		opts = append(opts, &unit.UnitOption{Section: "Service", Name: "WatchdogSec", Value: c.WatchdogSec})
+	}
+	return opts
+}
+
+// socketUnit builds the .socket unit that can hand the named, unix-domain
+// socket to the matching .service via FileDescriptorName=. It's generated
+// for users who want to opt into socket activation, but isn't pulled in by
+// default: it carries no WantedBy=, so `systemctl --user enable` on the
+// .service alone won't activate it. See the serviceUnit comment above.
+func (c Config) socketUnit(name, socketFile string) []*unit.UnitOption {
+	return []*unit.UnitOption{
+		{Section: "Unit", Name: "Description", Value: name + " socket"},
+		{Section: "Socket", Name: "ListenStream", Value: c.socketPath(socketFile)},
+		{Section: "Socket", Name: "FileDescriptorName", Value: name},
+		{Section: "Socket", Name: "RemoveOnStop", Value: "true"},
+	}
+}
+
+// Generate renders every unit file, keyed by filename, ready to be written
+// out with WriteAll.
+func Generate(cfg Config) (map[string]string, error) {
+	rendered := make(map[string]string)
+	for filename, opts := range cfg.namedUnits() {
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(unit.Serialize(opts)); err != nil {
+			return nil, fmt.Errorf("serializing %s: %s", filename, err)
+		}
+		rendered[filename] = buf.String()
+	}
+	return rendered, nil
+}
+
+// WriteAll generates every unit file and writes it atomically (via a
+// temp-file-then-rename) into destDir, which is normally
+// ~/.config/systemd/user/.
+func WriteAll(cfg Config, destDir string) error {
+	rendered, err := Generate(cfg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return fmt.Errorf("creating %s: %s", destDir, err)
+	}
+	for filename, contents := range rendered {
+		dest := filepath.Join(destDir, filename)
+		tmp, err := ioutil.TempFile(destDir, "."+filename+".tmp")
+		if err != nil {
+			return fmt.Errorf("creating temp file for %s: %s", filename, err)
+		}
+		if _, err := tmp.WriteString(contents); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return fmt.Errorf("writing %s: %s", filename, err)
+		}
+		if err := tmp.Close(); err != nil {
+			os.Remove(tmp.Name())
+			return fmt.Errorf("closing %s: %s", filename, err)
+		}
+		if err := os.Rename(tmp.Name(), dest); err != nil {
+			os.Remove(tmp.Name())
+			return fmt.Errorf("installing %s: %s", filename, err)
+		}
+	}
+	return nil
+}
+
+// DefaultDestDir returns ~/.config/systemd/user, the standard location for
+// user-level unit files, honoring $XDG_CONFIG_HOME if set.
+func DefaultDestDir() (string, error) {
+	if xdgConfigHome := os.Getenv("XDG_CONFIG_HOME"); xdgConfigHome != "" {
+		return filepath.Join(xdgConfigHome, "systemd", "user"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "systemd", "user"), nil
+}
@@ -0,0 +1,64 @@
+package units
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testConfig() Config {
+	return Config{
+		KeybaseBinaryPath: "/usr/bin/keybase",
+		KBFSBinaryPath:    "/usr/bin/kbfsfuse",
+		RuntimeDir:        "/run/user/1000",
+		WatchdogSec:       "30",
+	}
+}
+
+func TestGenerateIncludesAllUnits(t *testing.T) {
+	rendered, err := Generate(testConfig())
+	require.NoError(t, err)
+	require.Contains(t, rendered, "keybase.service")
+	require.Contains(t, rendered, "kbfs.service")
+	require.Contains(t, rendered, "keybase.socket")
+	require.Contains(t, rendered, "kbfs.socket")
+}
+
+func TestGeneratedServiceUnit(t *testing.T) {
+	rendered, err := Generate(testConfig())
+	require.NoError(t, err)
+
+	service := rendered["keybase.service"]
+	require.True(t, strings.Contains(service, "Type=notify"))
+	require.True(t, strings.Contains(service, "WatchdogSec=30"))
+	require.True(t, strings.Contains(service, "ExecStart=/usr/bin/keybase service"))
+	require.False(t, strings.Contains(service, "Requires="))
+}
+
+func TestGeneratedKBFSServiceUnit(t *testing.T) {
+	rendered, err := Generate(testConfig())
+	require.NoError(t, err)
+
+	service := rendered["kbfs.service"]
+	require.True(t, strings.Contains(service, "ExecStart=/usr/bin/kbfsfuse"))
+	require.False(t, strings.Contains(service, "Requires="))
+}
+
+func TestGeneratedSocketUnit(t *testing.T) {
+	rendered, err := Generate(testConfig())
+	require.NoError(t, err)
+
+	socket := rendered["kbfs.socket"]
+	require.True(t, strings.Contains(socket, "ListenStream=/run/user/1000/kbfsd.sock"))
+	require.True(t, strings.Contains(socket, "FileDescriptorName=kbfs"))
+	require.False(t, strings.Contains(socket, "WantedBy=sockets.target"))
+}
+
+func TestGenerateOmitsWatchdogWhenUnset(t *testing.T) {
+	cfg := testConfig()
+	cfg.WatchdogSec = ""
+	rendered, err := Generate(cfg)
+	require.NoError(t, err)
+	require.False(t, strings.Contains(rendered["keybase.service"], "WatchdogSec"))
+}